@@ -0,0 +1,78 @@
+package configure
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// httpConnectDialer implements proxy.Dialer for an HTTP proxy, issuing a
+// CONNECT request and handing back the tunnelled connection once the proxy
+// answers 200
+type httpConnectDialer struct {
+	addr     string
+	user     string
+	password string
+	forward  proxy.Dialer
+}
+
+func newHTTPConnectDialer(addr string, user string, password string, forward proxy.Dialer) proxy.Dialer {
+	return &httpConnectDialer{addr: addr, user: user, password: password, forward: forward}
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.user + ":" + d.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http connect to %s via %s failed: %s", addr, d.addr, resp.Status)
+	}
+
+	// br may have buffered bytes the proxy or target sent in the same
+	// segment as the CONNECT response; keep reading through it instead of
+	// the bare conn so that data isn't silently dropped
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn whose Read drains a bufio.Reader first, so
+// bytes already buffered ahead of a protocol handshake aren't lost
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
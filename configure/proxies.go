@@ -0,0 +1,120 @@
+package configure
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/proxy"
+)
+
+// Proxy describes a single upstream proxy entry as read from the config file.
+// Setting Upstream to another entry's name layers this proxy's dialer over
+// that entry's dialer instead of over a direct connection, producing a chain
+// (e.g. SOCKS5-over-HTTP CONNECT, or SOCKS5-over-SOCKS5)
+type Proxy struct {
+	Name     string
+	Protocol string // socks5, http-connect, shadowsocks, direct
+	Addr     string
+	User     string
+	Password string
+	Cipher   string // shadowsocks AEAD method, e.g. "aes-256-gcm"
+	Upstream string
+}
+
+// Proxies holds every configured Proxy, keyed by name
+type Proxies struct {
+	Proxies map[string]Proxy
+}
+
+// dialer builds the net/proxy.Dialer for a single Proxy entry, recursively
+// layering it over its Upstream entry's dialer when one is set
+func (proxies *Proxies) dialer(p Proxy) (proxy.Dialer, error) {
+	return proxies.dialerChain(p, map[string]bool{})
+}
+
+// dialerChain is dialer's recursive worker; seen tracks the proxy names
+// already visited in this Upstream chain so a cycle (A.Upstream = B,
+// B.Upstream = A) is rejected instead of recursing forever
+func (proxies *Proxies) dialerChain(p Proxy, seen map[string]bool) (proxy.Dialer, error) {
+	var forward proxy.Dialer = proxy.Direct
+	if p.Upstream != "" {
+		if seen[p.Upstream] {
+			return nil, fmt.Errorf("proxy chain cycle detected at %q", p.Upstream)
+		}
+		up, ok := proxies.Proxies[p.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("upstream proxy %q is not configured", p.Upstream)
+		}
+		seen[p.Upstream] = true
+		var err error
+		forward, err = proxies.dialerChain(up, seen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch p.Protocol {
+	case "", "direct":
+		return forward, nil
+	case "socks5":
+		var auth *proxy.Auth
+		if p.User != "" {
+			auth = &proxy.Auth{User: p.User, Password: p.Password}
+		}
+		return proxy.SOCKS5("tcp", p.Addr, auth, forward)
+	case "http-connect":
+		return newHTTPConnectDialer(p.Addr, p.User, p.Password, forward), nil
+	case "shadowsocks":
+		return newShadowsocksDialer(p.Addr, p.Cipher, p.Password, forward)
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol %q", p.Protocol)
+	}
+}
+
+// Dial opens a TCP connection to addr through the named proxy. When name is
+// empty it falls back to whatever ALL_PROXY/HTTPS_PROXY describe in the
+// environment, or a direct connection if neither is set. proxy.FromEnvironment
+// only reads ALL_PROXY/NO_PROXY, so HTTPS_PROXY is checked explicitly first
+func (proxies *Proxies) Dial(name string, addr string) (net.Conn, error) {
+	if name == "" {
+		if raw := os.Getenv("HTTPS_PROXY"); raw != "" {
+			d, err := envHTTPSProxyDialer(raw)
+			if err != nil {
+				return nil, err
+			}
+			return d.Dial("tcp", addr)
+		}
+		return proxy.FromEnvironment().Dial("tcp", addr)
+	}
+
+	p, ok := proxies.Proxies[name]
+	if !ok {
+		return nil, fmt.Errorf("proxy %q is not configured", name)
+	}
+
+	d, err := proxies.dialer(p)
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial("tcp", addr)
+}
+
+// envHTTPSProxyDialer builds a dialer for the HTTPS_PROXY environment
+// variable, which names an HTTP(S) proxy to CONNECT through rather than a
+// SOCKS5 endpoint like ALL_PROXY
+func envHTTPSProxyDialer(raw string) (proxy.Dialer, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTPS_PROXY %q: %s", raw, err)
+	}
+
+	user, password := "", ""
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	return newHTTPConnectDialer(u.Host, user, password, proxy.Direct), nil
+}
@@ -0,0 +1,48 @@
+package configure
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"golang.org/x/net/proxy"
+)
+
+// shadowsocksDialer implements proxy.Dialer for a Shadowsocks server: it
+// opens a plain connection to the server through forward and wraps it in
+// the AEAD cipher stream before handing it back
+type shadowsocksDialer struct {
+	addr    string
+	cipher  core.Cipher
+	forward proxy.Dialer
+}
+
+func newShadowsocksDialer(addr string, method string, password string, forward proxy.Dialer) (proxy.Dialer, error) {
+	cipher, err := core.PickCipher(method, nil, password)
+	if err != nil {
+		return nil, err
+	}
+	return &shadowsocksDialer{addr: addr, cipher: cipher, forward: forward}, nil
+}
+
+func (d *shadowsocksDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn = d.cipher.StreamConn(conn)
+
+	target := socks.ParseAddr(addr)
+	if target == nil {
+		conn.Close()
+		return nil, fmt.Errorf("shadowsocks: invalid target address %q", addr)
+	}
+	if _, err := conn.Write(target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
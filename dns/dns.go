@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"net"
+	"sync"
+)
+
+// Record is a single fake-DNS entry: which real hostname and which proxy
+// a resolved fake IP should be routed through
+type Record struct {
+	Hostname string
+	Proxy    string
+}
+
+// DnsTable maps fake IPs back to the Record they were minted for
+type DnsTable struct {
+	mu      sync.RWMutex
+	records map[string]*Record
+}
+
+// NewDnsTable creates an empty DnsTable
+func NewDnsTable() *DnsTable {
+	return &DnsTable{records: make(map[string]*Record)}
+}
+
+// GetByIP looks up the Record for a fake-DNS IP, returning nil if this IP
+// was never handed out by the fake resolver
+func (t *DnsTable) GetByIP(ip net.IP) *Record {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.records[ip.String()]
+}
+
+// Set stores the Record a fake IP resolves to
+func (t *DnsTable) Set(ip net.IP, record *Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.records[ip.String()] = record
+}
+
+// Dns is the fake-DNS subsystem handed to the tunnel package
+type Dns struct {
+	DnsTablePtr *DnsTable
+}
@@ -0,0 +1,106 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseRulesFile reads a rules file in Surge/Clash-style CSV lines, e.g.:
+//
+//	DOMAIN-SUFFIX,google.com,proxyA
+//	DOMAIN-KEYWORD,analytics,REJECT
+//	IP-CIDR,192.168.0.0/16,DIRECT
+//	GEOIP,CN,DIRECT
+//	PORT-RANGE,1-1024,BLOCK
+//	PROCESS-NAME,Dropbox,proxyA
+//
+// Blank lines and lines starting with '#' are ignored. geoDB may be nil if
+// no GEOIP rules are used.
+func ParseRulesFile(path string, geoDB *GeoIPDB) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []Rule
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRuleLine(line, geoDB)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNo, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseRuleLine(line string, geoDB *GeoIPDB) (Rule, error) {
+	fields := strings.Split(line, ",")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("expected TYPE,VALUE,TARGET, got %q", line)
+	}
+	kind := strings.ToUpper(strings.TrimSpace(fields[0]))
+	value := strings.TrimSpace(fields[1])
+	decision := parseTarget(strings.TrimSpace(fields[2]))
+
+	switch kind {
+	case "DOMAIN-SUFFIX":
+		return NewDomainSuffixRule(value, decision), nil
+	case "DOMAIN-KEYWORD":
+		return NewDomainKeywordRule(value, decision), nil
+	case "IP-CIDR":
+		return NewIPCIDRRule(value, decision)
+	case "PORT-RANGE":
+		low, high, err := parsePortRange(value)
+		if err != nil {
+			return nil, err
+		}
+		return NewPortRangeRule(low, high, decision), nil
+	case "GEOIP":
+		return NewGeoIPCountryRule(value, geoDB, decision), nil
+	case "PROCESS-NAME":
+		return NewProcessNameRule(value, decision), nil
+	default:
+		return nil, fmt.Errorf("unknown rule type %q", kind)
+	}
+}
+
+func parseTarget(target string) Decision {
+	switch strings.ToUpper(target) {
+	case "DIRECT":
+		return Decision{Action: Direct}
+	case "REJECT":
+		return Decision{Action: Reject}
+	case "BLOCK":
+		return Decision{Action: Block}
+	default:
+		return Decision{Action: ProxyTo, Proxy: target}
+	}
+}
+
+func parsePortRange(value string) (uint16, uint16, error) {
+	parts := strings.SplitN(value, "-", 2)
+	low, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return uint16(low), uint16(low), nil
+	}
+	high, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint16(low), uint16(high), nil
+}
@@ -0,0 +1,91 @@
+package router
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	cases := []struct {
+		value   string
+		low     uint16
+		high    uint16
+		wantErr bool
+	}{
+		{"80", 80, 80, false},
+		{"1-1024", 1, 1024, false},
+		{"0-65535", 0, 65535, false},
+		{"nope", 0, 0, true},
+		{"1-nope", 0, 0, true},
+	}
+
+	for _, c := range cases {
+		low, high, err := parsePortRange(c.value)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parsePortRange(%q): expected error, got none", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePortRange(%q): unexpected error: %s", c.value, err)
+			continue
+		}
+		if low != c.low || high != c.high {
+			t.Errorf("parsePortRange(%q) = %d, %d, want %d, %d", c.value, low, high, c.low, c.high)
+		}
+	}
+}
+
+func TestParseRuleLine(t *testing.T) {
+	cases := []struct {
+		line    string
+		wantErr bool
+	}{
+		{"DOMAIN-SUFFIX,example.com,proxyA", false},
+		{"DOMAIN-KEYWORD,ads,REJECT", false},
+		{"IP-CIDR,10.0.0.0/8,DIRECT", false},
+		{"PORT-RANGE,1-1024,BLOCK", false},
+		{"GEOIP,CN,DIRECT", false},
+		{"PROCESS-NAME,Dropbox,proxyA", false},
+		{"UNKNOWN,foo,DIRECT", true},
+		{"DOMAIN-SUFFIX,example.com", true},
+		{"IP-CIDR,not-a-cidr,DIRECT", true},
+		{"PORT-RANGE,not-a-range,DIRECT", true},
+	}
+
+	for _, c := range cases {
+		rule, err := parseRuleLine(c.line, nil)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseRuleLine(%q): expected error, got none", c.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRuleLine(%q): unexpected error: %s", c.line, err)
+			continue
+		}
+		if rule == nil {
+			t.Errorf("parseRuleLine(%q): expected a rule, got nil", c.line)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	cases := []struct {
+		target string
+		action Action
+		proxy  string
+	}{
+		{"DIRECT", Direct, ""},
+		{"direct", Direct, ""},
+		{"REJECT", Reject, ""},
+		{"BLOCK", Block, ""},
+		{"proxyA", ProxyTo, "proxyA"},
+	}
+
+	for _, c := range cases {
+		d := parseTarget(c.target)
+		if d.Action != c.action || d.Proxy != c.proxy {
+			t.Errorf("parseTarget(%q) = %+v, want Action=%v Proxy=%q", c.target, d, c.action, c.proxy)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package router
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIPDB wraps a MaxMind MMDB file for country lookups
+type GeoIPDB struct {
+	reader *maxminddb.Reader
+}
+
+// LoadGeoIPDB opens a GeoLite2/GeoIP2 Country MMDB file
+func LoadGeoIPDB(path string) (*GeoIPDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIPDB{reader: reader}, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 country code for ip
+func (db *GeoIPDB) Country(ip net.IP) (string, error) {
+	var record struct {
+		Country struct {
+			IsoCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := db.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	return record.Country.IsoCode, nil
+}
+
+// Close releases the underlying MMDB file
+func (db *GeoIPDB) Close() error {
+	return db.reader.Close()
+}
@@ -0,0 +1,49 @@
+//go:build darwin
+
+package router
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processNameByLocalPort shells out to lsof, which is the common way to map
+// a local TCP port back to an owning process on macOS without cgo
+func processNameByLocalPort(localPort uint16) (string, error) {
+	out, err := exec.Command("lsof", "-nP", "-iTCP", "-sTCP:ESTABLISHED").Output()
+	if err != nil {
+		return "", err
+	}
+
+	wantPort := strconv.Itoa(int(localPort))
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, field := range fields {
+			local, _, found := strings.Cut(field, "->")
+			if !found {
+				continue
+			}
+			if port := localAddrPort(local); port == wantPort {
+				return fields[0], nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no process found for local port %d", localPort)
+}
+
+// localAddrPort extracts the port from an lsof NAME field's local address,
+// e.g. "192.168.1.5:54321" or "[::1]:54321", using the last colon so an
+// IPv6 address's own colons aren't mistaken for the port separator
+func localAddrPort(addr string) string {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return ""
+	}
+	return addr[i+1:]
+}
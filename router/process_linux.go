@@ -0,0 +1,81 @@
+//go:build linux
+
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// processNameByLocalPort resolves the process owning localPort by walking
+// /proc/net/tcp for the matching inode, then /proc/<pid>/exe for its name
+func processNameByLocalPort(localPort uint16) (string, error) {
+	inode, err := inodeForPort("/proc/net/tcp", localPort)
+	if err != nil {
+		return "", err
+	}
+
+	procDirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range procDirs {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(fdDir + "/" + fd.Name())
+			if err != nil {
+				continue
+			}
+			if link == fmt.Sprintf("socket:[%s]", inode) {
+				exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+				if err != nil {
+					return "", err
+				}
+				parts := strings.Split(exe, "/")
+				return parts[len(parts)-1], nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no process found for local port %d", localPort)
+}
+
+func inodeForPort(path string, localPort uint16) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	wantHex := fmt.Sprintf("%04X", localPort)
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header line
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		localAddr := strings.Split(fields[1], ":")
+		if len(localAddr) != 2 {
+			continue
+		}
+		if localAddr[1] == wantHex {
+			return fields[9], nil
+		}
+	}
+	return "", fmt.Errorf("local port %d not found in %s", localPort, path)
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package router
+
+import "fmt"
+
+// processNameByLocalPort is unsupported outside linux/darwin, so
+// ProcessNameRule simply never matches there
+func processNameByLocalPort(localPort uint16) (string, error) {
+	return "", fmt.Errorf("process-name rules are not supported on this platform")
+}
@@ -0,0 +1,87 @@
+package router
+
+import (
+	"net"
+	"sync"
+)
+
+// Action is the outcome a matched Rule assigns to a flow
+type Action int
+
+const (
+	// Direct dials the destination without a configured proxy entry; the
+	// HTTPS_PROXY/ALL_PROXY environment fallback of Proxies.Dial still applies
+	Direct Action = iota
+	// ProxyTo dials through the named proxy
+	ProxyTo
+	// Reject tears the connection down immediately. It's a plain close,
+	// not a TCP RST: tunnel's netstack dependency has no reset primitive
+	Reject
+	// Block silently drops the flow, answering nothing
+	Block
+)
+
+// Decision is what a Router decided for one flow: what to do, and (for
+// ProxyTo) which proxy and (always) which hostname/IP to dial
+type Decision struct {
+	Action Action
+	Proxy  string
+	Host   string
+}
+
+// MatchContext is everything a Rule may need to decide whether it matches a flow
+type MatchContext struct {
+	Host      string // resolved hostname, or the destination IP's string form
+	IP        net.IP
+	Port      uint16
+	LocalPort uint16 // local (device-side) port, used by process-name rules
+}
+
+// Rule matches a flow and, when it matches, carries the Decision to return
+type Rule interface {
+	Match(ctx *MatchContext) bool
+	Decision() Decision
+}
+
+// Router holds an ordered list of Rules plus a default Decision for
+// anything no rule matches
+type Router struct {
+	mu      sync.RWMutex
+	rules   []Rule
+	Default Decision
+}
+
+// New creates a Router that falls back to Direct for unmatched flows
+func New() *Router {
+	return &Router{Default: Decision{Action: Direct}}
+}
+
+// SetRules atomically replaces the rule set, used both at startup and by
+// the hot-reload Watcher
+func (r *Router) SetRules(rules []Rule) {
+	r.mu.Lock()
+	r.rules = rules
+	r.mu.Unlock()
+}
+
+// Decide returns the first matching rule's Decision, or r.Default
+func (r *Router) Decide(ctx *MatchContext) Decision {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.Match(ctx) {
+			d := rule.Decision()
+			if d.Host == "" {
+				d.Host = ctx.Host
+			}
+			return d
+		}
+	}
+
+	d := r.Default
+	if d.Host == "" {
+		d.Host = ctx.Host
+	}
+	return d
+}
@@ -0,0 +1,124 @@
+package router
+
+import (
+	"net"
+	"strings"
+)
+
+// baseRule carries the Decision every concrete rule type returns on match
+type baseRule struct {
+	decision Decision
+}
+
+func (b baseRule) Decision() Decision {
+	return b.decision
+}
+
+// DomainSuffixRule matches when Host ends with Suffix, e.g. "google.com"
+// matching "www.google.com"
+type DomainSuffixRule struct {
+	baseRule
+	Suffix string
+}
+
+func NewDomainSuffixRule(suffix string, decision Decision) *DomainSuffixRule {
+	return &DomainSuffixRule{baseRule{decision}, strings.ToLower(suffix)}
+}
+
+func (rule *DomainSuffixRule) Match(ctx *MatchContext) bool {
+	host := strings.ToLower(ctx.Host)
+	return host == rule.Suffix || strings.HasSuffix(host, "."+rule.Suffix)
+}
+
+// DomainKeywordRule matches when Host contains Keyword anywhere
+type DomainKeywordRule struct {
+	baseRule
+	Keyword string
+}
+
+func NewDomainKeywordRule(keyword string, decision Decision) *DomainKeywordRule {
+	return &DomainKeywordRule{baseRule{decision}, strings.ToLower(keyword)}
+}
+
+func (rule *DomainKeywordRule) Match(ctx *MatchContext) bool {
+	return strings.Contains(strings.ToLower(ctx.Host), rule.Keyword)
+}
+
+// IPCIDRRule matches when the destination IP falls inside CIDR
+type IPCIDRRule struct {
+	baseRule
+	CIDR *net.IPNet
+}
+
+func NewIPCIDRRule(cidr string, decision Decision) (*IPCIDRRule, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return &IPCIDRRule{baseRule{decision}, ipNet}, nil
+}
+
+func (rule *IPCIDRRule) Match(ctx *MatchContext) bool {
+	return ctx.IP != nil && rule.CIDR.Contains(ctx.IP)
+}
+
+// PortRangeRule matches when the destination port falls within [Low, High]
+type PortRangeRule struct {
+	baseRule
+	Low  uint16
+	High uint16
+}
+
+func NewPortRangeRule(low uint16, high uint16, decision Decision) *PortRangeRule {
+	return &PortRangeRule{baseRule{decision}, low, high}
+}
+
+func (rule *PortRangeRule) Match(ctx *MatchContext) bool {
+	return ctx.Port >= rule.Low && ctx.Port <= rule.High
+}
+
+// GeoIPCountryRule matches when the destination IP's GeoIP country equals
+// Country (an ISO 3166-1 alpha-2 code, e.g. "CN")
+type GeoIPCountryRule struct {
+	baseRule
+	Country string
+	db      *GeoIPDB
+}
+
+func NewGeoIPCountryRule(country string, db *GeoIPDB, decision Decision) *GeoIPCountryRule {
+	return &GeoIPCountryRule{baseRule{decision}, strings.ToUpper(country), db}
+}
+
+func (rule *GeoIPCountryRule) Match(ctx *MatchContext) bool {
+	if ctx.IP == nil || rule.db == nil {
+		return false
+	}
+	country, err := rule.db.Country(ctx.IP)
+	if err != nil {
+		return false
+	}
+	return country == rule.Country
+}
+
+// ProcessNameRule matches when the process that owns the local socket for
+// this flow is named Name. Supported on darwin and linux only; see
+// process_linux.go, process_darwin.go and process_other.go
+type ProcessNameRule struct {
+	baseRule
+	Name string
+}
+
+func NewProcessNameRule(name string, decision Decision) *ProcessNameRule {
+	return &ProcessNameRule{baseRule{decision}, name}
+}
+
+func (rule *ProcessNameRule) Match(ctx *MatchContext) bool {
+	if ctx.LocalPort == 0 {
+		return false
+	}
+	name, err := processNameByLocalPort(ctx.LocalPort)
+	if err != nil {
+		return false
+	}
+	return name == rule.Name
+}
@@ -0,0 +1,68 @@
+package router
+
+import (
+	"log"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher reloads a Router's rules whenever the backing rules file changes
+// on disk, so edits take effect without restarting the tunnel
+type Watcher struct {
+	watcher *fsnotify.Watcher
+	router  *Router
+	path    string
+	geoDB   *GeoIPDB
+	done    chan struct{}
+}
+
+// WatchRulesFile starts watching path for changes and reloads rules into rt
+// whenever it is written. Call Close to stop watching
+func WatchRulesFile(path string, rt *Router, geoDB *GeoIPDB) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := fsw.Add(path); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+
+	w := &Watcher{watcher: fsw, router: rt, path: path, geoDB: geoDB, done: make(chan struct{})}
+	go w.loop()
+	return w, nil
+}
+
+func (w *Watcher) loop() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			rules, err := ParseRulesFile(w.path, w.geoDB)
+			if err != nil {
+				log.Println("[router] reload rules failed", err)
+				continue
+			}
+			w.router.SetRules(rules)
+			log.Printf("[router] reloaded %d rules from %s", len(rules), w.path)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("[router] watch error", err)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Close stops the watcher
+func (w *Watcher) Close() error {
+	close(w.done)
+	return w.watcher.Close()
+}
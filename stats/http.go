@@ -0,0 +1,65 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// flowJSON is the wire shape returned by the JSON snapshot endpoint
+type flowJSON struct {
+	Key        string `json:"key"`
+	Protocol   string `json:"protocol"`
+	RemoteHost string `json:"remote_host"`
+	Proxy      string `json:"proxy"`
+	BytesUp    uint64 `json:"bytes_up"`
+	BytesDown  uint64 `json:"bytes_down"`
+	StartTime  int64  `json:"start_time"`
+	LastActive int64  `json:"last_active"`
+}
+
+// Handler serves a JSON snapshot of every live flow, suitable for a small
+// management UI
+func (r *Registry) Handler(w http.ResponseWriter, req *http.Request) {
+	flows := r.Snapshot()
+	out := make([]flowJSON, 0, len(flows))
+	for _, fs := range flows {
+		out = append(out, flowJSON{
+			Key:        fs.Key,
+			Protocol:   fs.Protocol,
+			RemoteHost: fs.RemoteHost,
+			Proxy:      fs.Proxy,
+			BytesUp:    fs.BytesUp(),
+			BytesDown:  fs.BytesDown(),
+			StartTime:  fs.StartTime.Unix(),
+			LastActive: fs.LastActive().Unix(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// MetricsHandler serves every live flow's counters in Prometheus text
+// exposition format on /metrics
+func (r *Registry) MetricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP tun2socks_flow_bytes_up_total Bytes sent from local to remote for a flow")
+	fmt.Fprintln(w, "# TYPE tun2socks_flow_bytes_up_total counter")
+	for _, fs := range r.Snapshot() {
+		fmt.Fprintf(w, "tun2socks_flow_bytes_up_total{key=%q,protocol=%q,remote=%q,proxy=%q} %d\n",
+			fs.Key, fs.Protocol, fs.RemoteHost, fs.Proxy, fs.BytesUp())
+	}
+
+	fmt.Fprintln(w, "# HELP tun2socks_flow_bytes_down_total Bytes sent from remote to local for a flow")
+	fmt.Fprintln(w, "# TYPE tun2socks_flow_bytes_down_total counter")
+	for _, fs := range r.Snapshot() {
+		fmt.Fprintf(w, "tun2socks_flow_bytes_down_total{key=%q,protocol=%q,remote=%q,proxy=%q} %d\n",
+			fs.Key, fs.Protocol, fs.RemoteHost, fs.Proxy, fs.BytesDown())
+	}
+
+	fmt.Fprintln(w, "# HELP tun2socks_flows Number of flows currently being proxied")
+	fmt.Fprintln(w, "# TYPE tun2socks_flows gauge")
+	fmt.Fprintf(w, "tun2socks_flows %d\n", len(r.Snapshot()))
+}
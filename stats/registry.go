@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is published when a flow closes, carrying its final totals so
+// subscribers (logging, analytics) don't need to race the registry to read
+// them before the FlowStats is gone
+type Event struct {
+	Key        string
+	Protocol   string
+	RemoteHost string
+	Proxy      string
+	BytesUp    uint64
+	BytesDown  uint64
+	Duration   time.Duration
+	Reason     string
+}
+
+// Registry is the live set of flows currently being proxied, keyed by
+// 5-tuple. Default is the registry tunnels register themselves with
+type Registry struct {
+	mu    sync.RWMutex
+	flows map[string]*FlowStats
+	subs  []chan Event
+}
+
+// Default is the process-wide registry used by TcpTunnel and UdpTunnel
+var Default = NewRegistry()
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{flows: make(map[string]*FlowStats)}
+}
+
+// Register adds fs to the live set
+func (r *Registry) Register(fs *FlowStats) {
+	r.mu.Lock()
+	r.flows[fs.Key] = fs
+	r.mu.Unlock()
+}
+
+// Close removes fs from the live set and publishes a "flow closed" Event
+// with its final totals
+func (r *Registry) Close(fs *FlowStats, reason string) {
+	r.mu.Lock()
+	delete(r.flows, fs.Key)
+	subs := append([]chan Event(nil), r.subs...)
+	r.mu.Unlock()
+
+	event := Event{
+		Key:        fs.Key,
+		Protocol:   fs.Protocol,
+		RemoteHost: fs.RemoteHost,
+		Proxy:      fs.Proxy,
+		BytesUp:    fs.BytesUp(),
+		BytesDown:  fs.BytesDown(),
+		Duration:   time.Since(fs.StartTime),
+		Reason:     reason,
+	}
+	for _, ch := range subs {
+		select {
+		case ch <- event:
+		default: // a slow subscriber must not block flow teardown
+		}
+	}
+}
+
+// Subscribe returns a channel that receives every future "flow closed" Event
+func (r *Registry) Subscribe() chan Event {
+	ch := make(chan Event, 16)
+	r.mu.Lock()
+	r.subs = append(r.subs, ch)
+	r.mu.Unlock()
+	return ch
+}
+
+// Snapshot returns every currently live FlowStats, for the metrics/JSON endpoints
+func (r *Registry) Snapshot() []*FlowStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]*FlowStats, 0, len(r.flows))
+	for _, fs := range r.flows {
+		out = append(out, fs)
+	}
+	return out
+}
@@ -0,0 +1,12 @@
+package stats
+
+import "net/http"
+
+// ListenAndServe starts an HTTP server on addr exposing Default's Prometheus
+// metrics at /metrics and a JSON flow snapshot at /flows
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", Default.MetricsHandler)
+	mux.HandleFunc("/flows", Default.Handler)
+	return http.ListenAndServe(addr, mux)
+}
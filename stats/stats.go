@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// FlowStats tracks live counters for a single tunnel flow. Every field is
+// updated with atomic operations so tunnels can record activity on their
+// hot read/write paths without taking a lock
+type FlowStats struct {
+	Key        string
+	Protocol   string // tcp, udp
+	RemoteHost string
+	Proxy      string
+	StartTime  time.Time
+
+	bytesUp     uint64 // local -> remote
+	bytesDown   uint64 // remote -> local
+	packetsUp   uint64 // reads from the local side
+	packetsDown uint64 // reads from the remote side
+	lastActive  int64  // unix nano
+}
+
+// New creates a FlowStats for a flow identified by key (typically its
+// 5-tuple), already touched so LastActive is never zero
+func New(key string, protocol string, remoteHost string, proxy string) *FlowStats {
+	fs := &FlowStats{
+		Key:        key,
+		Protocol:   protocol,
+		RemoteHost: remoteHost,
+		Proxy:      proxy,
+		StartTime:  time.Now(),
+	}
+	fs.Touch()
+	return fs
+}
+
+// AddUp records n bytes sent from the local side to the remote side
+func (fs *FlowStats) AddUp(n int) {
+	atomic.AddUint64(&fs.bytesUp, uint64(n))
+	fs.Touch()
+}
+
+// AddDown records n bytes sent from the remote side to the local side
+func (fs *FlowStats) AddDown(n int) {
+	atomic.AddUint64(&fs.bytesDown, uint64(n))
+	fs.Touch()
+}
+
+// AddPacketUp records one packet/datagram read from the local side
+func (fs *FlowStats) AddPacketUp() {
+	atomic.AddUint64(&fs.packetsUp, 1)
+	fs.Touch()
+}
+
+// AddPacketDown records one packet/datagram read from the remote side
+func (fs *FlowStats) AddPacketDown() {
+	atomic.AddUint64(&fs.packetsDown, 1)
+	fs.Touch()
+}
+
+// Touch marks the flow as active right now
+func (fs *FlowStats) Touch() {
+	atomic.StoreInt64(&fs.lastActive, time.Now().UnixNano())
+}
+
+// BytesUp returns the running total of local->remote bytes
+func (fs *FlowStats) BytesUp() uint64 {
+	return atomic.LoadUint64(&fs.bytesUp)
+}
+
+// BytesDown returns the running total of remote->local bytes
+func (fs *FlowStats) BytesDown() uint64 {
+	return atomic.LoadUint64(&fs.bytesDown)
+}
+
+// PacketsUp returns the running total of packets/datagrams read locally
+func (fs *FlowStats) PacketsUp() uint64 {
+	return atomic.LoadUint64(&fs.packetsUp)
+}
+
+// PacketsDown returns the running total of packets/datagrams read remotely
+func (fs *FlowStats) PacketsDown() uint64 {
+	return atomic.LoadUint64(&fs.packetsDown)
+}
+
+// LastActive returns the time of the most recent AddUp/AddDown/Touch call
+func (fs *FlowStats) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&fs.lastActive))
+}
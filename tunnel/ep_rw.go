@@ -0,0 +1,194 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/FlowerWrong/netstack/tcpip"
+	"github.com/FlowerWrong/netstack/waiter"
+	"github.com/FlowerWrong/tun2socks/util"
+)
+
+// tcpMSS is the buffer size handed to io.CopyBuffer for the data path; it
+// approximates a typical TCP MSS over the tunnel's virtual interface so a
+// single Read/Write pulls one packet's worth of payload at a time
+const tcpMSS = 1460
+
+// bufferPool hands out tcpMSS-sized buffers for TcpTunnel's copy loops so
+// steady-state proxying does no per-packet allocation
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, tcpMSS)
+	},
+}
+
+// localReadWriter is what TcpTunnel's copy loops need from the local side:
+// either a bare epReadWriter, or one wrapped in a peekedReadWriter when some
+// bytes were already consumed from it while sniffing SNI/Host
+type localReadWriter interface {
+	io.Reader
+	io.Writer
+	CloseWrite() error
+	release()
+}
+
+// epReadWriter adapts a tcpip.Endpoint + waiter.Queue into an io.ReadWriter
+// so the data path can be driven by io.CopyBuffer instead of hand-rolled
+// channels. CloseWrite half-closes only the netstack->local direction,
+// letting the other direction keep running
+type epReadWriter struct {
+	ep             tcpip.Endpoint
+	wq             *waiter.Queue
+	waitEntry      waiter.Entry
+	notifyCh       chan struct{}
+	writeWaitEntry waiter.Entry
+	writeNotifyCh  chan struct{}
+	ctx            context.Context
+	leftover       []byte // unread remainder of the last ep.Read, replayed before the next one
+}
+
+func newEpReadWriter(ep tcpip.Endpoint, wq *waiter.Queue, ctx context.Context) *epReadWriter {
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventIn)
+	writeWaitEntry, writeNotifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&writeWaitEntry, waiter.EventOut)
+	return &epReadWriter{
+		ep: ep, wq: wq,
+		waitEntry: waitEntry, notifyCh: notifyCh,
+		writeWaitEntry: writeWaitEntry, writeNotifyCh: writeNotifyCh,
+		ctx: ctx,
+	}
+}
+
+// Read blocks until the netstack endpoint has data, the tunnel is
+// cancelled, or the endpoint is closed. When ep.Read returns more than
+// len(p), the remainder is kept in rw.leftover and replayed on the next
+// call instead of being dropped
+func (rw *epReadWriter) Read(p []byte) (int, error) {
+	if len(rw.leftover) > 0 {
+		n := copy(p, rw.leftover)
+		rw.leftover = rw.leftover[n:]
+		return n, nil
+	}
+
+	for {
+		v, err := rw.ep.Read(nil)
+		if err == nil {
+			n := copy(p, v)
+			if n < len(v) {
+				rw.leftover = v[n:]
+			}
+			return n, nil
+		}
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-rw.ctx.Done():
+				return 0, rw.ctx.Err()
+			case <-rw.notifyCh:
+				continue
+			}
+		}
+		if util.IsClosed(err) {
+			return 0, io.EOF
+		}
+		return 0, errors.New(err.String())
+	}
+}
+
+// Write blocks until all of p has been handed to the netstack endpoint, a
+// real error occurs, or the tunnel is cancelled. A short write with err ==
+// nil is retried with the remainder straight away, ErrWouldBlock waits for
+// writability before retrying, and a write that takes no bytes without an
+// error returns io.ErrShortWrite
+func (rw *epReadWriter) Write(p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		n, err := rw.ep.Write(p[written:], nil)
+		written += int(n)
+		if err == nil {
+			if n == 0 {
+				return written, io.ErrShortWrite
+			}
+			continue
+		}
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-rw.ctx.Done():
+				return written, rw.ctx.Err()
+			case <-rw.writeNotifyCh:
+				continue
+			}
+		}
+		if util.IsClosed(err) {
+			return written, io.EOF
+		}
+		return written, errors.New(err.String())
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the netstack endpoint's write direction, so the
+// local app sees EOF on its next read without losing data it already sent
+// that hasn't been relayed upstream yet
+func (rw *epReadWriter) CloseWrite() error {
+	if err := rw.ep.Shutdown(tcpip.ShutdownWrite); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
+
+func (rw *epReadWriter) release() {
+	rw.wq.EventUnregister(&rw.waitEntry)
+	rw.wq.EventUnregister(&rw.writeWaitEntry)
+}
+
+// peekedReadWriter replays bytes already consumed from the netstack
+// endpoint by sniffHostname before falling through to live reads, so the
+// SNI/Host peek never loses application data
+type peekedReadWriter struct {
+	prefix []byte
+	*epReadWriter
+}
+
+func newPeekedReadWriter(rw *epReadWriter, prefix []byte) *peekedReadWriter {
+	return &peekedReadWriter{prefix: prefix, epReadWriter: rw}
+}
+
+func (p *peekedReadWriter) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.epReadWriter.Read(b)
+}
+
+// countingWriter wraps an io.Writer to atomically tally every successful
+// write, used to feed the stats package without adding a lock to the copy loop
+type countingWriter struct {
+	w   io.Writer
+	add func(int)
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if n > 0 {
+		c.add(n)
+	}
+	return n, err
+}
+
+// closeWriter is implemented by net.Conn types (e.g. *net.TCPConn) that
+// support a TCP half-close
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// halfCloseWrite half-closes conn's write direction. Callers only pass conns
+// that implement closeWriter; one that doesn't is left to the eventual full
+// Close
+func halfCloseWrite(conn closeWriter) {
+	conn.CloseWrite()
+}
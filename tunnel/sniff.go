@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/FlowerWrong/netstack/tcpip"
+	"github.com/FlowerWrong/netstack/waiter"
+)
+
+const (
+	// sniffTimeout bounds how long NewSocks5Conneciton waits for the first
+	// bytes of a flow before giving up and dialing by IP instead
+	sniffTimeout = 200 * time.Millisecond
+	// sniffMaxBytes is large enough to hold a typical TLS ClientHello or an
+	// HTTP request line + headers without buffering an unbounded amount of
+	// client data before a proxy is even chosen
+	sniffMaxBytes = 4096
+)
+
+// peekLocal reads whatever the local app has already sent, stopping once it
+// holds max bytes or more (a single read may carry it past max), waiting at
+// most timeout for the first byte. It never blocks past timeout
+// and returns a short or empty read rather than an error when nothing
+// arrives in time, since the caller treats "nothing sniffed" as normal
+func peekLocal(ep tcpip.Endpoint, wq *waiter.Queue, timeout time.Duration, max int) ([]byte, error) {
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventIn)
+	defer wq.EventUnregister(&waitEntry)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var peeked []byte
+	for len(peeked) < max {
+		v, err := ep.Read(nil)
+		if err != nil {
+			if err == tcpip.ErrWouldBlock {
+				if len(peeked) > 0 {
+					return peeked, nil
+				}
+				select {
+				case <-notifyCh:
+					continue
+				case <-deadline.C:
+					return peeked, nil
+				}
+			}
+			return peeked, nil
+		}
+		peeked = append(peeked, v...)
+	}
+	return peeked, nil
+}
+
+// sniffHostname recovers the destination hostname from the first bytes of a
+// flow: a TLS ClientHello's SNI extension, or an HTTP request's Host header
+func sniffHostname(buf []byte) (string, bool) {
+	if host, ok := sniffTLSServerName(buf); ok {
+		return host, true
+	}
+	return sniffHTTPHost(buf)
+}
+
+// sniffTLSServerName parses just enough of a TLS record + ClientHello to
+// pull the server_name extension out, per RFC 8446 (and TLS 1.2, same wire
+// format for this part of the handshake)
+func sniffTLSServerName(buf []byte) (string, bool) {
+	if len(buf) < 5 || buf[0] != 0x16 { // not a TLS handshake record
+		return "", false
+	}
+	recordLen := int(buf[3])<<8 | int(buf[4])
+	body := buf[5:]
+	if len(body) > recordLen {
+		body = body[:recordLen]
+	}
+
+	if len(body) < 4 || body[0] != 0x01 { // not a ClientHello
+		return "", false
+	}
+	body = body[4:] // handshake type(1) + length(3)
+
+	if len(body) < 34 {
+		return "", false
+	}
+	body = body[34:] // client version(2) + random(32)
+
+	if len(body) < 1 {
+		return "", false
+	}
+	sessionIDLen := int(body[0])
+	body = body[1:]
+	if len(body) < sessionIDLen {
+		return "", false
+	}
+	body = body[sessionIDLen:]
+
+	if len(body) < 2 {
+		return "", false
+	}
+	cipherSuitesLen := int(body[0])<<8 | int(body[1])
+	body = body[2:]
+	if len(body) < cipherSuitesLen {
+		return "", false
+	}
+	body = body[cipherSuitesLen:]
+
+	if len(body) < 1 {
+		return "", false
+	}
+	compressionLen := int(body[0])
+	body = body[1:]
+	if len(body) < compressionLen {
+		return "", false
+	}
+	body = body[compressionLen:]
+
+	if len(body) < 2 {
+		return "", false
+	}
+	extensionsLen := int(body[0])<<8 | int(body[1])
+	body = body[2:]
+	if len(body) > extensionsLen {
+		body = body[:extensionsLen]
+	}
+
+	for len(body) >= 4 {
+		extType := int(body[0])<<8 | int(body[1])
+		extLen := int(body[2])<<8 | int(body[3])
+		body = body[4:]
+		if len(body) < extLen {
+			return "", false
+		}
+		extData := body[:extLen]
+		body = body[extLen:]
+
+		if extType != 0x0000 { // server_name
+			continue
+		}
+		if len(extData) < 2 {
+			return "", false
+		}
+		list := extData[2:]
+		if len(list) < 3 || list[0] != 0x00 { // host_name type
+			return "", false
+		}
+		nameLen := int(list[1])<<8 | int(list[2])
+		list = list[3:]
+		if len(list) < nameLen {
+			return "", false
+		}
+		return string(list[:nameLen]), true
+	}
+
+	return "", false
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+}
+
+// sniffHTTPHost recovers the Host header from the start of a plaintext HTTP
+// request, bounded to whatever was already peeked
+func sniffHTTPHost(buf []byte) (string, bool) {
+	isHTTP := false
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(buf, m) {
+			isHTTP = true
+			break
+		}
+	}
+	if !isHTTP {
+		return "", false
+	}
+
+	lines := bytes.Split(buf, []byte("\r\n"))
+	for _, line := range lines[1:] {
+		if len(line) >= 6 && bytes.EqualFold(line[:5], []byte("Host:")) {
+			host := bytes.TrimSpace(line[5:])
+			if len(host) == 0 {
+				return "", false
+			}
+			return string(host), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,67 @@
+package tunnel
+
+import "testing"
+
+// buildClientHello assembles a minimal TLS 1.2 ClientHello record carrying a
+// single server_name extension, just enough for sniffTLSServerName to parse
+func buildClientHello(serverName string) []byte {
+	entry := append([]byte{0x00, byte(len(serverName) >> 8), byte(len(serverName))}, serverName...)
+	extData := append([]byte{byte(len(entry) >> 8), byte(len(entry))}, entry...)
+	ext := append([]byte{0x00, 0x00, byte(len(extData) >> 8), byte(len(extData))}, extData...)
+
+	body := []byte{0x03, 0x03}               // client version
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0x00)                // session id len
+	body = append(body, 0x00, 0x02, 0x00, 0x2f)
+	body = append(body, 0x01, 0x00) // compression methods
+	body = append(body, byte(len(ext)>>8), byte(len(ext)))
+	body = append(body, ext...)
+
+	handshake := append([]byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	record := append([]byte{0x16, 0x03, 0x01, byte(len(handshake) >> 8), byte(len(handshake))}, handshake...)
+	return record
+}
+
+func TestSniffTLSServerName(t *testing.T) {
+	buf := buildClientHello("example.com")
+	host, ok := sniffTLSServerName(buf)
+	if !ok {
+		t.Fatalf("sniffTLSServerName: expected a match, got none")
+	}
+	if host != "example.com" {
+		t.Errorf("sniffTLSServerName: got %q, want %q", host, "example.com")
+	}
+}
+
+func TestSniffTLSServerNameRejectsNonTLS(t *testing.T) {
+	if _, ok := sniffTLSServerName([]byte("GET / HTTP/1.1\r\n")); ok {
+		t.Errorf("sniffTLSServerName: expected no match on a plaintext HTTP request")
+	}
+	if _, ok := sniffTLSServerName(nil); ok {
+		t.Errorf("sniffTLSServerName: expected no match on an empty buffer")
+	}
+}
+
+func TestSniffHTTPHost(t *testing.T) {
+	req := "GET /index.html HTTP/1.1\r\nHost: example.com\r\nUser-Agent: test\r\n\r\n"
+	host, ok := sniffHTTPHost([]byte(req))
+	if !ok {
+		t.Fatalf("sniffHTTPHost: expected a match, got none")
+	}
+	if host != "example.com" {
+		t.Errorf("sniffHTTPHost: got %q, want %q", host, "example.com")
+	}
+}
+
+func TestSniffHTTPHostRejectsNonHTTP(t *testing.T) {
+	if _, ok := sniffHTTPHost(buildClientHello("example.com")); ok {
+		t.Errorf("sniffHTTPHost: expected no match on a TLS ClientHello")
+	}
+}
+
+func TestSniffHTTPHostMissingHeader(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nUser-Agent: test\r\n\r\n"
+	if _, ok := sniffHTTPHost([]byte(req)); ok {
+		t.Errorf("sniffHTTPHost: expected no match when Host header is absent")
+	}
+}
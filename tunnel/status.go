@@ -0,0 +1,18 @@
+package tunnel
+
+// TunnelStatus is the lifecycle state of a TcpTunnel or UdpTunnel
+type TunnelStatus int
+
+const (
+	// StatusNew is a tunnel that has not started proxying yet
+	StatusNew TunnelStatus = iota
+	// StatusProxying is a tunnel actively relaying packets
+	StatusProxying
+	// StatusClosed is a tunnel that has been torn down; its context is
+	// cancelled and its connections are closed
+	StatusClosed
+)
+
+// PktChannelSize is the buffer size for a UdpTunnel's localPackets and
+// remotePackets channels
+const PktChannelSize = 16
@@ -8,68 +8,137 @@ import (
 	"github.com/FlowerWrong/netstack/waiter"
 	"github.com/FlowerWrong/tun2socks/configure"
 	"github.com/FlowerWrong/tun2socks/dns"
+	"github.com/FlowerWrong/tun2socks/router"
+	"github.com/FlowerWrong/tun2socks/stats"
 	"github.com/FlowerWrong/tun2socks/util"
+	"io"
 	"log"
 	"net"
 	"sync"
 )
 
+// ErrBlocked is returned by NewSocks5Conneciton when a router rule says to
+// silently drop the flow
+var ErrBlocked = errors.New("tunnel: flow blocked by router rule")
+
+// ErrRejected is returned by NewSocks5Conneciton when a router rule says to
+// refuse the flow; the endpoint has already been closed by then (no RST --
+// see the router.Reject case in NewSocks5Conneciton)
+var ErrRejected = errors.New("tunnel: flow rejected by router rule")
+
 // Tcp tunnel
 type TcpTunnel struct {
-	wq            *waiter.Queue
-	ep            tcpip.Endpoint
-	socks5Conn    net.Conn
-	remotePackets chan []byte // write to local
-	localPackets  chan []byte // write to remote, socks5
-	ctx           context.Context
-	ctxCancel     context.CancelFunc
-	closeOne      sync.Once    // to avoid multi close tunnel
-	status        TunnelStatus // to avoid panic: send on closed channel
-	rwMutex       sync.RWMutex
+	wq         *waiter.Queue
+	ep         tcpip.Endpoint
+	socks5Conn net.Conn
+	peeked     []byte // bytes already consumed from ep while sniffing SNI/Host
+	stats      *stats.FlowStats
+	ctx        context.Context
+	ctxCancel  context.CancelFunc
+	closeOne   sync.Once // to avoid multi close tunnel
+	status     TunnelStatus
+	rwMutex    sync.RWMutex
 }
 
 // Create a tcp tunnel
-func NewTCP2Socks(wq *waiter.Queue, ep tcpip.Endpoint, ip net.IP, port uint16, fakeDns *dns.Dns, proxies *configure.Proxies) (*TcpTunnel, error) {
-	socks5Conn, err := NewSocks5Conneciton(ip, port, fakeDns, proxies)
+func NewTCP2Socks(wq *waiter.Queue, ep tcpip.Endpoint, ip net.IP, port uint16, fakeDns *dns.Dns, proxies *configure.Proxies, rt *router.Router) (*TcpTunnel, error) {
+	socks5Conn, remoteAddr, proxy, peeked, err := NewSocks5Conneciton(wq, ep, ip, port, fakeDns, proxies, rt)
 	if err != nil {
-		log.Println("New socks5 conn failed", err)
+		if err != ErrBlocked && err != ErrRejected {
+			log.Println("New socks5 conn failed", err)
+		}
 		return nil, err
 	}
 
+	key := fmt.Sprintf("tcp:%d-%s", localPort(ep), remoteAddr)
+	flowStats := stats.New(key, "tcp", remoteAddr, proxy)
+	stats.Default.Register(flowStats)
+
 	return &TcpTunnel{
-		wq:            wq,
-		ep:            ep,
-		socks5Conn:    *socks5Conn,
-		remotePackets: make(chan []byte, PktChannelSize),
-		localPackets:  make(chan []byte, PktChannelSize),
-		rwMutex:       sync.RWMutex{},
+		wq:         wq,
+		ep:         ep,
+		socks5Conn: *socks5Conn,
+		peeked:     peeked,
+		stats:      flowStats,
+		rwMutex:    sync.RWMutex{},
 	}, nil
 }
 
-// New socks5 connection
-func NewSocks5Conneciton(ip net.IP, port uint16, fakeDns *dns.Dns, proxies *configure.Proxies) (*net.Conn, error) {
-	var remoteAddr string
-	proxy := ""
-
+// Resolve the remote address and proxy name for an endpoint's destination
+// IP, reversing it through the fake-DNS table when possible so hostname-based
+// proxy rules still apply after the netstack only sees a fake IP
+func resolveRemote(ip net.IP, port uint16, fakeDns *dns.Dns) (remoteAddr string, proxy string) {
 	if fakeDns != nil {
 		record := fakeDns.DnsTablePtr.GetByIP(ip)
 		if record != nil {
-			remoteAddr = fmt.Sprintf("%v:%d", record.Hostname, port)
-			proxy = record.Proxy
-		} else {
-			remoteAddr = fmt.Sprintf("%v:%d", ip, port)
+			return fmt.Sprintf("%v:%d", record.Hostname, port), record.Proxy
+		}
+	}
+	return fmt.Sprintf("%v:%d", ip, port), ""
+}
+
+// New socks5 connection. When rt is non-nil, the router is consulted first
+// and may redirect the proxy, reject the flow (closes ep without dialing) or
+// block it outright instead of dialing anything. When the fake-DNS table has no
+// record for ip, it peeks the flow's first bytes for a TLS SNI or HTTP Host
+// header before falling back to dialing the raw IP, so hostname-based proxy
+// rules and SNI-picky CDNs still work. Returns the resolved remote address,
+// proxy name and any peeked bytes (which must be replayed to socks5Conn)
+// alongside the conn so callers can label stats and not lose data
+func NewSocks5Conneciton(wq *waiter.Queue, ep tcpip.Endpoint, ip net.IP, port uint16, fakeDns *dns.Dns, proxies *configure.Proxies, rt *router.Router) (*net.Conn, string, string, []byte, error) {
+	remoteAddr, proxy := resolveRemote(ip, port, fakeDns)
+
+	var peeked []byte
+	if fakeDns == nil || fakeDns.DnsTablePtr.GetByIP(ip) == nil {
+		if buf, err := peekLocal(ep, wq, sniffTimeout, sniffMaxBytes); err == nil && len(buf) > 0 {
+			peeked = buf
+			if host, ok := sniffHostname(buf); ok {
+				remoteAddr = fmt.Sprintf("%s:%d", host, port)
+			}
+		}
+	}
+
+	if rt != nil {
+		host, _, _ := net.SplitHostPort(remoteAddr)
+		decision := rt.Decide(&router.MatchContext{
+			Host:      host,
+			IP:        ip,
+			Port:      port,
+			LocalPort: localPort(ep),
+		})
+		switch decision.Action {
+		case router.Block:
+			return nil, remoteAddr, proxy, peeked, ErrBlocked
+		case router.Reject:
+			// The netstack version vendored here has no RST/Abort
+			// primitive on tcpip.Endpoint, only a graceful Close; that's
+			// the best a Reject decision can get, so it closes instead
+			// of resetting the connection
+			ep.Close()
+			return nil, remoteAddr, proxy, peeked, ErrRejected
+		case router.ProxyTo:
+			proxy = decision.Proxy
+		case router.Direct:
+			proxy = ""
 		}
-	} else {
-		remoteAddr = fmt.Sprintf("%v:%d", ip, port)
 	}
 
 	socks5Conn, err := proxies.Dial(proxy, remoteAddr)
 	if err != nil {
-		socks5Conn.Close()
 		log.Printf("[tcp] dial %s by proxy %q failed: %s", remoteAddr, proxy, err)
-		return nil, err
+		return nil, remoteAddr, proxy, peeked, err
+	}
+	return &socks5Conn, remoteAddr, proxy, peeked, nil
+}
+
+// localPort returns the device-side source port of ep, used by
+// PROCESS-NAME router rules; 0 if it cannot be determined
+func localPort(ep tcpip.Endpoint) uint16 {
+	addr, err := ep.GetLocalAddress()
+	if err != nil {
+		return 0
 	}
-	return &socks5Conn, nil
+	return addr.Port
 }
 
 // Set tcp tunnel status with rwMutex
@@ -87,111 +156,66 @@ func (tcpTunnel *TcpTunnel) Status() TunnelStatus {
 	return s
 }
 
-// Start tcp tunnel
+// Start tcp tunnel. The data path is two independent io.CopyBuffer loops so
+// one direction finishing (half-close) doesn't tear down the other, which
+// keep-alive HTTP and SMTP both rely on
 func (tcpTunnel *TcpTunnel) Run() {
 	tcpTunnel.ctx, tcpTunnel.ctxCancel = context.WithCancel(context.Background())
-	go tcpTunnel.writeToLocal()
-	go tcpTunnel.readFromRemote()
-	go tcpTunnel.writeToRemote()
-	go tcpTunnel.readFromLocal()
+	epRW := newEpReadWriter(tcpTunnel.ep, tcpTunnel.wq, tcpTunnel.ctx)
+	var local localReadWriter = epRW
+	if len(tcpTunnel.peeked) > 0 {
+		local = newPeekedReadWriter(epRW, tcpTunnel.peeked)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go tcpTunnel.copyToRemote(&wg, local)
+	go tcpTunnel.copyToLocal(&wg, local)
+
+	go func() {
+		wg.Wait()
+		local.release()
+		tcpTunnel.Close(errors.New("tcp flow finished"))
+	}()
+
 	tcpTunnel.SetStatus(StatusProxying)
 }
 
-// Read tcp packet form local netstack
-func (tcpTunnel *TcpTunnel) readFromLocal() {
-	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
-	tcpTunnel.wq.EventRegister(&waitEntry, waiter.EventIn)
-	defer tcpTunnel.wq.EventUnregister(&waitEntry)
-
-readFromLocal:
-	for {
-		v, err := tcpTunnel.ep.Read(nil)
-		if err != nil {
-			if err == tcpip.ErrWouldBlock {
-				select {
-				case <-tcpTunnel.ctx.Done():
-					break readFromLocal
-				case <-notifyCh:
-					continue readFromLocal
-				}
-			}
-			if !util.IsClosed(err) {
-				log.Println("Read from local failed", err)
-			}
-			tcpTunnel.Close(errors.New("read from local failed" + err.String()))
-			break readFromLocal
-		}
-		if tcpTunnel.status != StatusClosed {
-			tcpTunnel.localPackets <- v
-		} else {
-			break readFromLocal
-		}
+// copyToRemote drains the local netstack endpoint into socks5Conn. Once the
+// local side is done sending, it half-closes socks5Conn's write side so the
+// upstream sees EOF without losing data still in flight the other way
+func (tcpTunnel *TcpTunnel) copyToRemote(wg *sync.WaitGroup, local localReadWriter) {
+	defer wg.Done()
+
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+
+	dst := countingWriter{w: tcpTunnel.socks5Conn, add: tcpTunnel.stats.AddUp}
+	_, err := io.CopyBuffer(dst, local, buf)
+	if err != nil && err != io.EOF && err != context.Canceled && !util.IsClosed(err) {
+		log.Println("Copy to remote failed", err)
 	}
-}
 
-// Write tcp packet to upstream
-func (tcpTunnel *TcpTunnel) writeToRemote() {
-writeToRemote:
-	for {
-		select {
-		case <-tcpTunnel.ctx.Done():
-			break writeToRemote
-		case chunk := <-tcpTunnel.localPackets:
-			// tcpTunnel.socks5Conn.SetWriteDeadline(DefaultReadWriteTimeout)
-			_, err := tcpTunnel.socks5Conn.Write(chunk)
-			if err != nil && !util.IsEOF(err) {
-				log.Println("Write packet to remote failed", err)
-				tcpTunnel.Close(err)
-				break writeToRemote
-			}
-		}
+	if cw, ok := tcpTunnel.socks5Conn.(closeWriter); ok {
+		halfCloseWrite(cw)
 	}
 }
 
-// Read tcp packet from upstream
-func (tcpTunnel *TcpTunnel) readFromRemote() {
-readFromRemote:
-	for {
-		select {
-		case <-tcpTunnel.ctx.Done():
-			break readFromRemote
-		default:
-			buf := make([]byte, 1500)
-			// tcpTunnel.socks5Conn.SetReadDeadline(DefaultReadWriteTimeout)
-			n, err := tcpTunnel.socks5Conn.Read(buf)
-			if err != nil && !util.IsEOF(err) {
-				log.Println("Read from remote failed", err)
-				tcpTunnel.Close(err)
-				break readFromRemote
-			}
+// copyToLocal drains socks5Conn into the local netstack endpoint. Once the
+// remote side is done sending, it half-closes the endpoint's write side
+func (tcpTunnel *TcpTunnel) copyToLocal(wg *sync.WaitGroup, local localReadWriter) {
+	defer wg.Done()
 
-			if n > 0 && tcpTunnel.status != StatusClosed {
-				tcpTunnel.remotePackets <- buf[0:n]
-			} else {
-				break readFromRemote
-			}
-		}
-	}
-}
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
 
-// Write tcp packet to local netstack
-func (tcpTunnel *TcpTunnel) writeToLocal() {
-writeToLocal:
-	for {
-		select {
-		case <-tcpTunnel.ctx.Done():
-			break writeToLocal
-		case chunk := <-tcpTunnel.remotePackets:
-			_, err := tcpTunnel.ep.Write(chunk, nil)
-			if err != nil {
-				if !util.IsClosed(err) {
-					log.Println("Write to local failed", err)
-				}
-				tcpTunnel.Close(errors.New(err.String()))
-				break writeToLocal
-			}
-		}
+	dst := countingWriter{w: local, add: tcpTunnel.stats.AddDown}
+	_, err := io.CopyBuffer(dst, tcpTunnel.socks5Conn, buf)
+	if err != nil && err != io.EOF && !util.IsClosed(err) {
+		log.Println("Copy to local failed", err)
 	}
+
+	local.CloseWrite()
 }
 
 // Close this tcp tunnel
@@ -201,7 +225,6 @@ func (tcpTunnel *TcpTunnel) Close(reason error) {
 		tcpTunnel.ctxCancel()
 		tcpTunnel.socks5Conn.Close()
 		tcpTunnel.ep.Close()
-		close(tcpTunnel.localPackets)
-		close(tcpTunnel.remotePackets)
+		stats.Default.Close(tcpTunnel.stats, reason.Error())
 	})
 }
@@ -0,0 +1,292 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/FlowerWrong/netstack/tcpip"
+	"github.com/FlowerWrong/netstack/waiter"
+	"github.com/FlowerWrong/tun2socks/configure"
+	"github.com/FlowerWrong/tun2socks/dns"
+	"github.com/FlowerWrong/tun2socks/stats"
+	"github.com/FlowerWrong/tun2socks/util"
+)
+
+// UdpIdleTimeout is how long a UdpTunnel waits without traffic in either
+// direction before tearing itself down, since UDP has no FIN to signal the
+// end of a flow
+const UdpIdleTimeout = 60 * time.Second
+
+// Udp tunnel, relays a single UDP flow through a SOCKS5 UDP ASSOCIATE session
+type UdpTunnel struct {
+	wq            *waiter.Queue
+	ep            tcpip.Endpoint
+	assoc         *configure.UDPAssoc
+	dstHost       string
+	dstPort       uint16
+	remotePackets chan []byte // write to local
+	localPackets  chan []byte // write to remote, socks5
+	stats         *stats.FlowStats
+	ctx           context.Context
+	ctxCancel     context.CancelFunc
+	closeOne      sync.Once
+	status        TunnelStatus
+	rwMutex       sync.RWMutex
+	idleTimer     *time.Timer
+}
+
+// Create a udp tunnel
+func NewUdpTunnel(wq *waiter.Queue, ep tcpip.Endpoint, ip net.IP, port uint16, fakeDns *dns.Dns, proxies *configure.Proxies) (*UdpTunnel, error) {
+	remoteAddr, proxy := resolveRemote(ip, port, fakeDns)
+
+	assoc, err := proxies.DialUDP(proxy, remoteAddr)
+	if err != nil {
+		log.Printf("[udp] associate %s by proxy %q failed: %s", remoteAddr, proxy, err)
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		assoc.Close()
+		return nil, err
+	}
+
+	key := fmt.Sprintf("udp:%d-%s", localPort(ep), remoteAddr)
+	flowStats := stats.New(key, "udp", remoteAddr, proxy)
+	stats.Default.Register(flowStats)
+
+	return &UdpTunnel{
+		wq:            wq,
+		ep:            ep,
+		assoc:         assoc,
+		dstHost:       host,
+		dstPort:       port,
+		remotePackets: make(chan []byte, PktChannelSize),
+		localPackets:  make(chan []byte, PktChannelSize),
+		stats:         flowStats,
+		rwMutex:       sync.RWMutex{},
+	}, nil
+}
+
+// Set udp tunnel status with rwMutex
+func (udpTunnel *UdpTunnel) SetStatus(s TunnelStatus) {
+	udpTunnel.rwMutex.Lock()
+	udpTunnel.status = s
+	udpTunnel.rwMutex.Unlock()
+}
+
+// Get udp tunnel status with rwMutex
+func (udpTunnel *UdpTunnel) Status() TunnelStatus {
+	udpTunnel.rwMutex.Lock()
+	s := udpTunnel.status
+	udpTunnel.rwMutex.Unlock()
+	return s
+}
+
+// Start udp tunnel
+func (udpTunnel *UdpTunnel) Run() {
+	udpTunnel.ctx, udpTunnel.ctxCancel = context.WithCancel(context.Background())
+	udpTunnel.idleTimer = time.AfterFunc(UdpIdleTimeout, func() {
+		udpTunnel.Close(errors.New("udp flow idle timeout"))
+	})
+	go udpTunnel.writeToLocal()
+	go udpTunnel.readFromRemote()
+	go udpTunnel.writeToRemote()
+	go udpTunnel.readFromLocal()
+	udpTunnel.SetStatus(StatusProxying)
+}
+
+func (udpTunnel *UdpTunnel) bumpIdle() {
+	udpTunnel.idleTimer.Reset(UdpIdleTimeout)
+}
+
+// Read udp packet from local netstack
+func (udpTunnel *UdpTunnel) readFromLocal() {
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	udpTunnel.wq.EventRegister(&waitEntry, waiter.EventIn)
+	defer udpTunnel.wq.EventUnregister(&waitEntry)
+
+readFromLocal:
+	for {
+		v, err := udpTunnel.ep.Read(nil)
+		if err != nil {
+			if err == tcpip.ErrWouldBlock {
+				select {
+				case <-udpTunnel.ctx.Done():
+					break readFromLocal
+				case <-notifyCh:
+					continue readFromLocal
+				}
+			}
+			if !util.IsClosed(err) {
+				log.Println("[udp] read from local failed", err)
+			}
+			udpTunnel.Close(errors.New("read from local failed" + err.String()))
+			break readFromLocal
+		}
+		udpTunnel.stats.AddPacketUp()
+		select {
+		case udpTunnel.localPackets <- v:
+		case <-udpTunnel.ctx.Done():
+			break readFromLocal
+		}
+	}
+}
+
+// Write udp datagram to upstream, wrapped in the SOCKS5 UDP request header
+func (udpTunnel *UdpTunnel) writeToRemote() {
+writeToRemote:
+	for {
+		select {
+		case <-udpTunnel.ctx.Done():
+			break writeToRemote
+		case chunk := <-udpTunnel.localPackets:
+			header, err := socks5UdpHeader(udpTunnel.dstHost, udpTunnel.dstPort)
+			if err != nil {
+				log.Println("[udp] build socks5 header failed", err)
+				udpTunnel.Close(err)
+				break writeToRemote
+			}
+			n, err := udpTunnel.assoc.Write(append(header, chunk...))
+			if err != nil && !util.IsEOF(err) {
+				log.Println("[udp] write datagram to remote failed", err)
+				udpTunnel.Close(err)
+				break writeToRemote
+			}
+			if n >= len(header) {
+				udpTunnel.stats.AddUp(n - len(header))
+			}
+			udpTunnel.bumpIdle()
+		}
+	}
+}
+
+// Read udp datagram from upstream, stripping the SOCKS5 UDP request header
+func (udpTunnel *UdpTunnel) readFromRemote() {
+readFromRemote:
+	for {
+		select {
+		case <-udpTunnel.ctx.Done():
+			break readFromRemote
+		default:
+			buf := make([]byte, 1500)
+			n, err := udpTunnel.assoc.Read(buf)
+			if err != nil && !util.IsEOF(err) {
+				log.Println("[udp] read datagram from remote failed", err)
+				udpTunnel.Close(err)
+				break readFromRemote
+			}
+
+			if n > 0 {
+				payload, err := stripSocks5UdpHeader(buf[0:n])
+				if err != nil {
+					log.Println("[udp] strip socks5 header failed", err)
+					continue readFromRemote
+				}
+				udpTunnel.stats.AddPacketDown()
+				select {
+				case udpTunnel.remotePackets <- payload:
+					udpTunnel.bumpIdle()
+				case <-udpTunnel.ctx.Done():
+					break readFromRemote
+				}
+			} else {
+				break readFromRemote
+			}
+		}
+	}
+}
+
+// Write udp datagram to local netstack
+func (udpTunnel *UdpTunnel) writeToLocal() {
+writeToLocal:
+	for {
+		select {
+		case <-udpTunnel.ctx.Done():
+			break writeToLocal
+		case chunk := <-udpTunnel.remotePackets:
+			n, err := udpTunnel.ep.Write(chunk, nil)
+			udpTunnel.stats.AddDown(int(n))
+			if err != nil {
+				if !util.IsClosed(err) {
+					log.Println("[udp] write to local failed", err)
+				}
+				udpTunnel.Close(errors.New(err.String()))
+				break writeToLocal
+			}
+		}
+	}
+}
+
+// Close this udp tunnel
+func (udpTunnel *UdpTunnel) Close(reason error) {
+	udpTunnel.closeOne.Do(func() {
+		udpTunnel.SetStatus(StatusClosed)
+		udpTunnel.idleTimer.Stop()
+		udpTunnel.ctxCancel()
+		udpTunnel.assoc.Close()
+		udpTunnel.ep.Close()
+		stats.Default.Close(udpTunnel.stats, reason.Error())
+	})
+}
+
+// socks5UdpHeader builds the RSV/FRAG/ATYP/DST.ADDR/DST.PORT prefix that
+// precedes every datagram sent over a SOCKS5 UDP ASSOCIATE relay (RFC 1928 7)
+func socks5UdpHeader(host string, port uint16) ([]byte, error) {
+	header := []byte{0x00, 0x00, 0x00} // RSV, RSV, FRAG=0
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			header = append(header, 0x01)
+			header = append(header, ip4...)
+		} else {
+			header = append(header, 0x04)
+			header = append(header, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname %q too long for socks5 UDP request", host)
+		}
+		header = append(header, 0x03, byte(len(host)))
+		header = append(header, host...)
+	}
+
+	return append(header, byte(port>>8), byte(port)), nil
+}
+
+// stripSocks5UdpHeader removes the RSV/FRAG/ATYP/DST.ADDR/DST.PORT prefix a
+// proxy prepends to every datagram it relays back
+func stripSocks5UdpHeader(buf []byte) ([]byte, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("socks5 UDP datagram too short")
+	}
+	if buf[2] != 0x00 {
+		return nil, fmt.Errorf("fragmented socks5 UDP datagrams are not supported")
+	}
+
+	offset := 4
+	switch buf[3] {
+	case 0x01:
+		offset += net.IPv4len
+	case 0x04:
+		offset += net.IPv6len
+	case 0x03:
+		if len(buf) < offset+1 {
+			return nil, fmt.Errorf("socks5 UDP datagram too short")
+		}
+		offset += 1 + int(buf[offset])
+	default:
+		return nil, fmt.Errorf("unsupported socks5 ATYP %d", buf[3])
+	}
+
+	offset += 2 // DST.PORT
+	if len(buf) < offset {
+		return nil, fmt.Errorf("socks5 UDP datagram too short")
+	}
+	return buf[offset:], nil
+}
@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSocks5UdpHeaderRoundTrip(t *testing.T) {
+	cases := []struct {
+		host string
+		port uint16
+	}{
+		{"93.184.216.34", 80},
+		{"2606:2800:220:1:248:1893:25c8:1946", 443},
+		{"example.com", 443},
+	}
+
+	for _, c := range cases {
+		header, err := socks5UdpHeader(c.host, c.port)
+		if err != nil {
+			t.Fatalf("socks5UdpHeader(%q, %d): unexpected error: %s", c.host, c.port, err)
+		}
+
+		payload := append(append([]byte{}, header...), []byte("hello")...)
+		got, err := stripSocks5UdpHeader(payload)
+		if err != nil {
+			t.Fatalf("stripSocks5UdpHeader round trip for %q: unexpected error: %s", c.host, err)
+		}
+		if !bytes.Equal(got, []byte("hello")) {
+			t.Errorf("stripSocks5UdpHeader round trip for %q: got %q, want %q", c.host, got, "hello")
+		}
+	}
+}
+
+func TestSocks5UdpHeaderHostnameTooLong(t *testing.T) {
+	longHost := string(make([]byte, 256))
+	if _, err := socks5UdpHeader(longHost, 80); err == nil {
+		t.Errorf("socks5UdpHeader with a 256-byte hostname: expected error, got none")
+	}
+}
+
+func TestStripSocks5UdpHeaderErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		buf  []byte
+	}{
+		{"too short", []byte{0x00, 0x00}},
+		{"fragmented", []byte{0x00, 0x00, 0x01, 0x01, 1, 2, 3, 4, 0, 80}},
+		{"unsupported atyp", []byte{0x00, 0x00, 0x00, 0x05, 0, 80}},
+		{"truncated domain", []byte{0x00, 0x00, 0x00, 0x03, 10}},
+	}
+
+	for _, c := range cases {
+		if _, err := stripSocks5UdpHeader(c.buf); err == nil {
+			t.Errorf("stripSocks5UdpHeader(%s): expected error, got none", c.name)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// IsEOF reports whether err is (or wraps) io.EOF
+func IsEOF(err error) bool {
+	return errors.Is(err, io.EOF)
+}
+
+// IsClosed reports whether err indicates use of an already closed
+// net.Conn/net.PacketConn, so callers can avoid logging expected noise
+// during teardown
+func IsClosed(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	return strings.Contains(err.Error(), "use of closed network connection")
+}